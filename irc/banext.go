@@ -0,0 +1,145 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ERR_LINKCHANNEL is sent instead of ERR_BANNEDFROMCHAN when a ban that
+// carries a `$#forward` target redirects the client to another channel.
+const ERR_LINKCHANNEL = "470"
+
+// extBan is a single parsed extended-ban-syntax entry, one of:
+//
+//	$a:<account>       banned if logged in as <account>
+//	$~a                banned if not logged in to any account
+//	$r:<realname-glob> banned if realname matches the glob
+//	$j:<#channel>      banned if currently a member of <#channel>
+//
+// plus an optional `$#forward` suffix (also usable on its own with a
+// plain glob mask) that redirects a blocked JOIN to another channel
+// instead of rejecting it outright.
+type extBan struct {
+	raw     string // original mask string, kept for mode -b removal
+	kind    byte   // 'a', 'A' ($~a), 'r', 'j', or 0 for a plain glob mask
+	arg     string
+	forward Name
+	Setter  string    // nickmask of whoever set the ban, for ShowMaskList/persistence
+	SetAt   time.Time // when the ban was set, for ShowMaskList/persistence
+}
+
+// parseExtBan recognizes the extended-ban/channel-forward syntax. ok is
+// false for an ordinary glob mask with no forward suffix, which the
+// caller should store in the plain UserMaskSet as before.
+func parseExtBan(mask string) (ban extBan, ok bool) {
+	ban.raw = mask
+	body := mask
+
+	if idx := strings.LastIndex(mask, "$#"); idx != -1 {
+		ban.forward = NewName(mask[idx+1:])
+		body = mask[:idx]
+	}
+
+	switch {
+	case body == "$~a":
+		ban.kind = 'A'
+		return ban, true
+	case strings.HasPrefix(body, "$a:"):
+		ban.kind = 'a'
+		ban.arg = strings.TrimPrefix(body, "$a:")
+		return ban, true
+	case strings.HasPrefix(body, "$r:"):
+		ban.kind = 'r'
+		ban.arg = strings.TrimPrefix(body, "$r:")
+		return ban, true
+	case strings.HasPrefix(body, "$j:"):
+		ban.kind = 'j'
+		ban.arg = strings.TrimPrefix(body, "$j:")
+		return ban, true
+	}
+
+	if ban.forward != "" {
+		// A plain glob mask with only a forward suffix still needs to
+		// be recorded here rather than the ordinary UserMaskSet, since
+		// that's what carries the forward target.
+		ban.arg = body
+		return ban, true
+	}
+
+	return extBan{}, false
+}
+
+// matches reports whether client is covered by this extended ban.
+func (ban extBan) matches(client *Client) bool {
+	switch ban.kind {
+	case 'a':
+		return client.account != "" && client.account == ban.arg
+	case 'A':
+		return client.account == ""
+	case 'r':
+		matched, _ := filepath.Match(ban.arg, client.realname)
+		return matched
+	case 'j':
+		other := client.server.channels.Get(NewName(ban.arg))
+		return other != nil && other.members.Has(client)
+	default:
+		return matchUserHostMask(ban.arg, client.UserHost())
+	}
+}
+
+// matchUserHostMask matches a plain nick!user@host glob the same way
+// the ordinary ban/except/invite lists do.
+func matchUserHostMask(mask string, userhost Name) bool {
+	set := NewUserMaskSet()
+	set.Add(NewName(mask))
+	return set.Match(userhost)
+}
+
+// applyExtBan adds or removes an extended-ban-syntax entry, keyed by
+// its original mask string. setter is only used (and recorded) on Add.
+func (channel *Channel) applyExtBan(op ModeOp, ban extBan, setter string) bool {
+	switch op {
+	case Add:
+		for _, existing := range channel.banExtra {
+			if existing.raw == ban.raw {
+				return false
+			}
+		}
+		ban.Setter = setter
+		ban.SetAt = time.Now().UTC()
+		channel.banExtra = append(channel.banExtra, ban)
+		return true
+
+	case Remove:
+		for i, existing := range channel.banExtra {
+			if existing.raw == ban.raw {
+				channel.banExtra = append(channel.banExtra[:i], channel.banExtra[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// matchBans reports whether client is banned from channel, either by an
+// ordinary +b glob mask or by one of the extended-syntax entries, and
+// the forward target if the matching entry carries one.
+func (channel *Channel) matchBans(client *Client) (banned bool, forward Name) {
+	if channel.lists[BanMask].Match(client.UserHost()) {
+		banned = true
+	}
+	for _, ban := range channel.banExtra {
+		if ban.matches(client) {
+			banned = true
+			if ban.forward != "" {
+				forward = ban.forward
+			}
+		}
+	}
+	return
+}
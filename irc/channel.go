@@ -12,22 +12,31 @@ import (
 )
 
 type Channel struct {
-	flags      ChannelModeSet
-	lists      map[ChannelMode]*UserMaskSet
-	key        string
-	members    MemberSet
-	name       Name
-	nameString string
-	server     *Server
-	topic      string
-	userLimit  uint64
+	banExtra         []extBan
+	flags            ChannelModeSet
+	floodMuteSeconds int
+	floodState       map[*Client]*memberBuckets
+	history          *channelHistory
+	joinBucket       floodConfig
+	lists            map[ChannelMode]*UserMaskSet
+	key              string
+	maskMeta         map[ChannelMode]map[Name]maskEntry
+	members          MemberSet
+	msgBucket        floodConfig
+	name             Name
+	nameString       string
+	quietMasks       *UserMaskSet
+	server           *Server
+	topic            string
+	userLimit        uint64
 }
 
 // NewChannel creates a new channel from a `Server` and a `name`
 // string, which must be unique on the server.
 func NewChannel(s *Server, name Name, addDefaultModes bool) *Channel {
 	channel := &Channel{
-		flags: make(ChannelModeSet),
+		flags:   make(ChannelModeSet),
+		history: NewChannelHistory(DefaultHistoryLimit),
 		lists: map[ChannelMode]*UserMaskSet{
 			BanMask:    NewUserMaskSet(),
 			ExceptMask: NewUserMaskSet(),
@@ -133,6 +142,7 @@ func (channel *Channel) ModeString(client *Client) (str string) {
 	isMember := client.flags[Operator] || channel.members.Has(client)
 	showKey := isMember && (channel.key != "")
 	showUserLimit := channel.userLimit > 0
+	showFlood := channel.msgBucket.Lines > 0
 
 	// flags with args
 	if showKey {
@@ -141,6 +151,9 @@ func (channel *Channel) ModeString(client *Client) (str string) {
 	if showUserLimit {
 		str += UserLimit.String()
 	}
+	if showFlood {
+		str += Flood.String()
+	}
 
 	// flags
 	for mode := range channel.flags {
@@ -157,6 +170,9 @@ func (channel *Channel) ModeString(client *Client) (str string) {
 	if showUserLimit {
 		str += " " + strconv.FormatUint(channel.userLimit, 10)
 	}
+	if showFlood {
+		str += " " + channel.msgBucket.String()
+	}
 
 	return
 }
@@ -171,6 +187,19 @@ func (channel *Channel) CheckKey(key string) bool {
 }
 
 func (channel *Channel) Join(client *Client, key string) {
+	channel.join(client, key, nil)
+}
+
+// maxForwardDepth bounds how many `$#forward`-chained channels a single
+// JOIN will follow before giving up, so a forwarding cycle (two channels
+// forwarding to each other, or one forwarding to itself) can't recurse
+// forever.
+const maxForwardDepth = 10
+
+// join is Join's recursive implementation: visited tracks the channels
+// already followed by this JOIN's forward chain, so a cycle is detected
+// instead of recursing until the stack overflows.
+func (channel *Channel) join(client *Client, key string, visited map[Name]bool) {
 	if channel.members.Has(client) {
 		// already joined, no message?
 		return
@@ -186,15 +215,33 @@ func (channel *Channel) Join(client *Client, key string) {
 		return
 	}
 
+	if !channel.checkJoinFlood(client) {
+		client.Send(nil, client.server.name, "FAIL", "JOIN", "RATELIMITED", channel.nameString, "You have joined this channel too quickly")
+		return
+	}
+
 	isInvited := channel.lists[InviteMask].Match(client.UserHost())
 	if channel.flags[InviteOnly] && !isInvited {
 		client.Send(nil, client.server.name, ERR_INVITEONLYCHAN, channel.nameString, "Cannot join channel (+i)")
 		return
 	}
 
-	if channel.lists[BanMask].Match(client.UserHost()) &&
+	if banned, forward := channel.matchBans(client); banned &&
 		!isInvited &&
 		!channel.lists[ExceptMask].Match(client.UserHost()) {
+		if forward != "" {
+			if target := channel.server.channels.Get(forward); target != nil {
+				if visited == nil {
+					visited = make(map[Name]bool)
+				}
+				visited[channel.name] = true
+				if len(visited) <= maxForwardDepth && !visited[forward] {
+					client.Send(nil, client.server.name, ERR_LINKCHANNEL, channel.nameString, forward.String(), "Forwarding to another channel")
+					target.join(client, "", visited)
+					return
+				}
+			}
+		}
 		client.Send(nil, client.server.name, ERR_BANNEDFROMCHAN, channel.nameString, "Cannot join channel (+b)")
 		return
 	}
@@ -206,7 +253,15 @@ func (channel *Channel) Join(client *Client, key string) {
 		channel.members[client][ChannelOperator] = true
 	}
 
-	client.Send(nil, client.nickMaskString, "JOIN", channel.nameString)
+	channel.AppendHistory(HistoryJoin, client.nickMaskString, "", "")
+
+	channel.broadcastTagged(client, "", eventTags(client), "JOIN", channel.nameString)
+
+	if client.capabilities[ChatHistoryCap] {
+		const joinReplayCount = 50
+		channel.replayHistory(client, joinReplayCount)
+	}
+
 	return
 	//TODO(dan): should we be continuing here????
 	// return was above this originally, is it required?
@@ -219,15 +274,15 @@ func (channel *Channel) Join(client *Client, key string) {
 	*/
 }
 
-func (channel *Channel) Part(client *Client, message string) {
+func (channel *Channel) Part(client *Client, message string, label string) {
 	if !channel.members.Has(client) {
 		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.nameString, "You're not on that channel")
 		return
 	}
 
-	for member := range channel.members {
-		member.Send(nil, client.nickMaskString, "PART", channel.nameString, message)
-	}
+	channel.AppendHistory(HistoryPart, client.nickMaskString, "", message)
+
+	channel.broadcastTagged(client, label, eventTags(client), "PART", channel.nameString, message)
 	channel.Quit(client)
 }
 
@@ -246,22 +301,22 @@ func (channel *Channel) GetTopic(client *Client) {
 	client.Send(nil, client.server.name, RPL_TOPIC, channel.nameString, channel.topic)
 }
 
-func (channel *Channel) SetTopic(client *Client, topic string) {
+func (channel *Channel) SetTopic(client *Client, topic string, label string) {
 	if !(client.flags[Operator] || channel.members.Has(client)) {
 		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.nameString, "You're not on that channel")
 		return
 	}
 
-	if channel.flags[OpOnlyTopic] && !channel.ClientIsOperator(client) {
+	if channel.flags[OpOnlyTopic] && !channel.clientHasAtLeast(client, Halfop) {
 		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
 		return
 	}
 
 	channel.topic = topic
 
-	for member := range channel.members {
-		member.Send(nil, client.nickMaskString, "TOPIC", channel.nameString, channel.topic)
-	}
+	channel.AppendHistory(HistoryTopic, client.nickMaskString, "", channel.topic)
+
+	channel.broadcastTagged(client, label, eventTags(client), "TOPIC", channel.nameString, channel.topic)
 
 	if err := channel.Persist(); err != nil {
 		log.Println("Channel.Persist:", channel, err)
@@ -272,6 +327,9 @@ func (channel *Channel) CanSpeak(client *Client) bool {
 	if client.flags[Operator] {
 		return true
 	}
+	if channel.isQuieted(client) {
+		return false
+	}
 	if channel.flags[NoOutside] && !channel.members.Has(client) {
 		return false
 	}
@@ -282,23 +340,33 @@ func (channel *Channel) CanSpeak(client *Client) bool {
 	return true
 }
 
-func (channel *Channel) PrivMsg(client *Client, message string) {
+func (channel *Channel) PrivMsg(client *Client, message string, label string) {
 	if !channel.CanSpeak(client) {
 		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.nameString, "Cannot send to channel")
 		return
 	}
-	for member := range channel.members {
-		if member == client {
-			continue
-		}
-		//TODO(dan): use nickmask instead of nickString here lel
-		member.Send(nil, client.nickMaskString, "PRIVMSG", channel.nameString, message)
+	if !channel.checkMsgFlood(client) {
+		channel.rejectFlood(client, "PRIVMSG")
+		return
+	}
+	channel.AppendHistory(HistoryPrivMsg, client.nickMaskString, "", message)
+
+	channel.broadcastTaggedEcho(client, label, eventTags(client), "PRIVMSG", channel.nameString, message)
+}
+
+// rejectFlood sends the standard-reply FAIL for a message dropped by
+// the flood governor, auto-muting the sender for a cooldown if the
+// channel is configured to do so.
+func (channel *Channel) rejectFlood(client *Client, command string) {
+	client.Send(nil, client.server.name, "FAIL", command, "RATELIMITED", channel.nameString, "You are sending too fast")
+	if channel.floodMuteSeconds > 0 {
+		channel.muteFlooder(client)
 	}
 }
 
 func (channel *Channel) applyModeFlag(client *Client, mode ChannelMode,
 	op ModeOp) bool {
-	if !channel.ClientIsOperator(client) {
+	if !channel.clientHasAtLeast(client, Halfop) {
 		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
 		return false
 	}
@@ -323,7 +391,7 @@ func (channel *Channel) applyModeFlag(client *Client, mode ChannelMode,
 
 func (channel *Channel) applyModeMember(client *Client, mode ChannelMode,
 	op ModeOp, nick string) bool {
-	if !channel.ClientIsOperator(client) {
+	if !channel.clientHasAtLeast(client, Halfop) {
 		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
 		return false
 	}
@@ -366,13 +434,22 @@ func (channel *Channel) applyModeMember(client *Client, mode ChannelMode,
 }
 
 func (channel *Channel) ShowMaskList(client *Client, mode ChannelMode) {
-	//TODO(dan): WE NEED TO fiX this PROPERLY
-	log.Fatal("Implement ShowMaskList")
-	/*
-		for lmask := range channel.lists[mode].masks {
-			client.RplMaskList(mode, channel, lmask)
+	listReply, endReply := maskListReplies(mode)
+
+	for _, entry := range channel.maskMeta[mode] {
+		client.Send(nil, client.server.name, listReply, client.nickString, channel.nameString,
+			entry.Mask.String(), entry.Setter, strconv.FormatInt(entry.SetAt.Unix(), 10))
+	}
+	if mode == BanMask {
+		// Extended-ban-syntax entries ($a:, $~a, $r:, $j:, $#forward)
+		// live outside the ordinary UserMaskSet, but still belong on the
+		// +b list.
+		for _, ban := range channel.banExtra {
+			client.Send(nil, client.server.name, listReply, client.nickString, channel.nameString,
+				ban.raw, ban.Setter, strconv.FormatInt(ban.SetAt.Unix(), 10))
 		}
-		client.RplEndOfMaskList(mode, channel)*/
+	}
+	client.Send(nil, client.server.name, endReply, client.nickString, channel.nameString, "End of list")
 }
 
 func (channel *Channel) applyModeMask(client *Client, mode ChannelMode, op ModeOp,
@@ -388,17 +465,33 @@ func (channel *Channel) applyModeMask(client *Client, mode ChannelMode, op ModeO
 		return false
 	}
 
-	if !channel.ClientIsOperator(client) {
+	if !channel.clientHasAtLeast(client, Halfop) {
 		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
 		return false
 	}
 
+	// $a:, $~a, $r:, $j: extended bans and mask$#forward channel
+	// forwarding live outside the ordinary glob-mask UserMaskSet.
+	if mode == BanMask {
+		if ban, ok := parseExtBan(mask.String()); ok {
+			return channel.applyExtBan(op, ban, client.nickMaskString)
+		}
+	}
+
 	if op == Add {
-		return list.Add(mask)
+		if !list.Add(mask) {
+			return false
+		}
+		channel.recordMaskMeta(mode, mask, client.nickMaskString)
+		return true
 	}
 
 	if op == Remove {
-		return list.Remove(mask)
+		if !list.Remove(mask) {
+			return false
+		}
+		channel.forgetMaskMeta(mode, mask)
+		return true
 	}
 
 	return false
@@ -413,6 +506,34 @@ func (channel *Channel) applyMode(client *Client, change *ChannelModeChange) boo
 	case InviteOnly, Moderated, NoOutside, OpOnlyTopic, Persistent, Secret:
 		return channel.applyModeFlag(client, change.mode, change.op)
 
+	case Flood:
+		if !channel.clientHasAtLeast(client, Halfop) {
+			client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
+			return false
+		}
+
+		switch change.op {
+		case Add:
+			conf, ok := parseFloodConfig(change.arg)
+			if !ok {
+				client.Send(nil, client.server.name, ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
+				return false
+			}
+			if conf == channel.msgBucket {
+				return false
+			}
+			channel.msgBucket = conf
+			return true
+
+		case Remove:
+			if channel.msgBucket == (floodConfig{}) {
+				return false
+			}
+			channel.msgBucket = floodConfig{}
+			return true
+		}
+		return false
+
 	case Key:
 		if !channel.ClientIsOperator(client) {
 			client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
@@ -439,6 +560,11 @@ func (channel *Channel) applyMode(client *Client, change *ChannelModeChange) boo
 		}
 
 	case UserLimit:
+		if !channel.ClientIsOperator(client) {
+			client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
+			return false
+		}
+
 		limit, err := strconv.ParseUint(change.arg, 10, 64)
 		if err != nil {
 			client.Send(nil, client.server.name, ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
@@ -452,24 +578,15 @@ func (channel *Channel) applyMode(client *Client, change *ChannelModeChange) boo
 		return true
 
 	case ChannelFounder, ChannelAdmin, ChannelOperator, Halfop, Voice:
-		var hasPrivs bool
-
-		// make sure client has privs to edit the given prefix
-		for _, mode := range ChannelPrivModes {
-			if channel.members[client][mode] {
-				hasPrivs = true
-
-				// Admins can't give other people Admin or remove it from others,
-				// standard for that channel mode, we worry about this later
-				if mode == ChannelAdmin && change.mode == ChannelAdmin {
-					hasPrivs = false
-				}
-
-				break
-			} else if mode == change.mode {
-				break
-			}
-		}
+		// A client may assign a privilege mode to someone else if they
+		// hold that rank or higher on the ladder - so a Halfop can give
+		// out Voice, an Operator can give out Halfop or Operator, and so
+		// on. The one exception is ChannelAdmin: an Admin can't grant or
+		// revoke Admin on anyone else, only a Founder can.
+		actorLevel := channel.ClientPrivLevel(client)
+		targetLevel := levelForMode(change.mode)
+		hasPrivs := client.flags[Operator] ||
+			(actorLevel >= targetLevel && !(change.mode == ChannelAdmin && actorLevel == targetLevel))
 
 		name := NewName(change.arg)
 
@@ -490,7 +607,7 @@ func (channel *Channel) applyMode(client *Client, change *ChannelModeChange) boo
 	return false
 }
 
-func (channel *Channel) Mode(client *Client, changes ChannelModeChanges) {
+func (channel *Channel) Mode(client *Client, changes ChannelModeChanges, label string) {
 	if len(changes) == 0 {
 		client.Send(nil, client.server.name, RPL_CHANNELMODEIS, channel.nameString, channel.ModeString(client))
 		return
@@ -505,9 +622,12 @@ func (channel *Channel) Mode(client *Client, changes ChannelModeChanges) {
 
 	if len(applied) > 0 {
 		appliedString := applied.String()
-		for member := range channel.members {
-			member.Send(nil, client.nickMaskString, "MODE", channel.nameString, appliedString)
-		}
+		// MODE can apply several changes at once; a labeled-response
+		// client gets them wrapped in a batch so it can tell they all
+		// resulted from the one command it sent.
+		client.sendBatch(label, "labeled-response", func() {
+			channel.broadcastTagged(client, label, eventTags(client), "MODE", channel.nameString, appliedString)
+		})
 
 		if err := channel.Persist(); err != nil {
 			log.Println("Channel.Persist:", channel, err)
@@ -515,62 +635,60 @@ func (channel *Channel) Mode(client *Client, changes ChannelModeChanges) {
 	}
 }
 
+// Persist schedules channel's current state to be written out by the
+// server's ChannelStore. The write itself happens asynchronously on the
+// store's write-behind queue, so this never blocks on disk I/O.
 func (channel *Channel) Persist() (err error) {
-	if channel.flags[Persistent] {
-		_, err = channel.server.db.Exec(`
-            INSERT OR REPLACE INTO channel
-              (name, flags, key, topic, user_limit, ban_list, except_list,
-               invite_list)
-              VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-			channel.name.String(), channel.flags.String(), channel.key,
-			channel.topic, channel.userLimit, channel.lists[BanMask].String(),
-			channel.lists[ExceptMask].String(), channel.lists[InviteMask].String())
-	} else {
-		_, err = channel.server.db.Exec(`
-            DELETE FROM channel WHERE name = ?`, channel.name.String())
-	}
-	return
+	channel.server.channelStore.Snapshot(channel)
+	return nil
 }
 
-func (channel *Channel) Notice(client *Client, message string) {
+func (channel *Channel) Notice(client *Client, message string, label string) {
 	if !channel.CanSpeak(client) {
 		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.nameString, "Cannot send to channel")
 		return
 	}
-	for member := range channel.members {
-		if member == client {
-			continue
-		}
-		member.Send(nil, client.nickMaskString, "NOTICE", channel.nameString, message)
+	if !channel.checkMsgFlood(client) {
+		channel.rejectFlood(client, "NOTICE")
+		return
 	}
+	channel.AppendHistory(HistoryNotice, client.nickMaskString, "", message)
+
+	channel.broadcastTaggedEcho(client, label, eventTags(client), "NOTICE", channel.nameString, message)
 }
 
 func (channel *Channel) Quit(client *Client) {
 	channel.members.Remove(client)
 	client.channels.Remove(channel)
+	delete(channel.floodState, client)
 
 	if !channel.flags[Persistent] && channel.IsEmpty() {
 		channel.server.channels.Remove(channel)
 	}
 }
 
-func (channel *Channel) Kick(client *Client, target *Client, comment string) {
+func (channel *Channel) Kick(client *Client, target *Client, comment string, label string) {
 	if !(client.flags[Operator] || channel.members.Has(client)) {
 		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.nameString, "You're not on that channel")
 		return
 	}
-	if !channel.ClientIsOperator(client) {
+	if !channel.clientHasAtLeast(client, Halfop) {
 		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.nameString, "Cannot send to channel")
 		return
 	}
+	if channel.HasPrivOver(target, client) {
+		// Halfops (and anyone else) can't kick someone who outranks them.
+		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.nameString, "You're not a channel operator")
+		return
+	}
 	if !channel.members.Has(target) {
 		client.Send(nil, client.server.name, ERR_USERNOTINCHANNEL, client.nickString, channel.nameString, "They aren't on that channel")
 		return
 	}
 
-	for member := range channel.members {
-		member.Send(nil, client.nickMaskString, "KICK", channel.nameString, target.nickString, comment)
-	}
+	channel.AppendHistory(HistoryKick, client.nickMaskString, target.nickString, comment)
+
+	channel.broadcastTagged(client, label, eventTags(client), "KICK", channel.nameString, target.nickString, comment)
 	channel.Quit(target)
 }
 
@@ -587,6 +705,7 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client) {
 
 	if channel.flags[InviteOnly] {
 		channel.lists[InviteMask].Add(invitee.UserHost())
+		channel.recordMaskMeta(InviteMask, invitee.UserHost(), inviter.nickMaskString)
 		if err := channel.Persist(); err != nil {
 			log.Println("Channel.Persist:", channel, err)
 		}
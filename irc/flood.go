@@ -0,0 +1,175 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flood is the InspIRCd-style +F lines:seconds channel mode: at most
+// `lines` PRIVMSGs/NOTICEs per `seconds` before the flood governor
+// kicks in. Unset (the zero floodConfig), messages are not rate
+// limited; there is no server-wide default.
+const Flood ChannelMode = 'F'
+
+// DefaultFloodMuteSeconds is the cooldown muteFlooder falls back to when
+// channel.floodMuteSeconds isn't positive. rejectFlood only auto-mutes
+// in a channel whose floodMuteSeconds is positive, so it never uses it.
+const DefaultFloodMuteSeconds = 60
+
+// floodConfig is a parsed +F argument: at most Lines events per
+// Seconds.
+type floodConfig struct {
+	Lines   int
+	Seconds int
+}
+
+// parseFloodConfig parses an InspIRCd-style "lines:seconds" +F
+// argument.
+func parseFloodConfig(arg string) (conf floodConfig, ok bool) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return conf, false
+	}
+
+	lines, err1 := strconv.Atoi(parts[0])
+	seconds, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || lines <= 0 || seconds <= 0 {
+		return conf, false
+	}
+
+	return floodConfig{Lines: lines, Seconds: seconds}, true
+}
+
+func (conf floodConfig) String() string {
+	if conf.Lines <= 0 {
+		return ""
+	}
+	return strconv.Itoa(conf.Lines) + ":" + strconv.Itoa(conf.Seconds)
+}
+
+// tokenBucket is a lazily-refilled lines-per-period flood governor: no
+// background timer, it just figures out how many tokens would have
+// accrued since it was last touched whenever Take is called.
+type tokenBucket struct {
+	capacity float64
+	period   time.Duration
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(conf floodConfig) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(conf.Lines),
+		period:   time.Duration(conf.Seconds) * time.Second,
+		tokens:   float64(conf.Lines),
+		last:     time.Now(),
+	}
+}
+
+// Take reports whether an event is allowed right now, consuming a
+// token if so.
+func (bucket *tokenBucket) Take() bool {
+	now := time.Now()
+	elapsed := now.Sub(bucket.last)
+	bucket.last = now
+
+	if bucket.period > 0 {
+		bucket.tokens += elapsed.Seconds() / bucket.period.Seconds() * bucket.capacity
+		if bucket.tokens > bucket.capacity {
+			bucket.tokens = bucket.capacity
+		}
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// memberBuckets holds one client's per-channel flood-governor state:
+// a message bucket and a join bucket, both created lazily on first use.
+type memberBuckets struct {
+	msg  *tokenBucket
+	join *tokenBucket
+}
+
+func (channel *Channel) bucketsFor(client *Client) *memberBuckets {
+	if channel.floodState == nil {
+		channel.floodState = make(map[*Client]*memberBuckets)
+	}
+	buckets, ok := channel.floodState[client]
+	if !ok {
+		buckets = &memberBuckets{}
+		channel.floodState[client] = buckets
+	}
+	return buckets
+}
+
+// checkMsgFlood reports whether client may send another PRIVMSG/NOTICE
+// to channel right now, consuming a token from their message bucket if
+// so. Voiced members and above bypass the governor entirely.
+func (channel *Channel) checkMsgFlood(client *Client) bool {
+	if client.flags[Operator] || channel.ClientPrivLevel(client) >= levelForMode(Voice) {
+		return true
+	}
+	if channel.msgBucket.Lines <= 0 {
+		return true
+	}
+
+	buckets := channel.bucketsFor(client)
+	if buckets.msg == nil {
+		buckets.msg = newTokenBucket(channel.msgBucket)
+	}
+	return buckets.msg.Take()
+}
+
+// checkJoinFlood is checkMsgFlood's counterpart for JOIN. Global
+// operators bypass the governor entirely; unlike checkMsgFlood there's
+// no per-channel privilege to exempt here, since a client isn't a
+// channel member yet at the point this runs.
+func (channel *Channel) checkJoinFlood(client *Client) bool {
+	if client.flags[Operator] {
+		return true
+	}
+	if channel.joinBucket.Lines <= 0 {
+		return true
+	}
+
+	buckets := channel.bucketsFor(client)
+	if buckets.join == nil {
+		buckets.join = newTokenBucket(channel.joinBucket)
+	}
+	return buckets.join.Take()
+}
+
+// muteFlooder auto-quiets client for channel.floodMuteSeconds (or
+// DefaultFloodMuteSeconds) by adding their mask to the quiet list,
+// scheduling its own removal once the cooldown elapses.
+func (channel *Channel) muteFlooder(client *Client) {
+	cooldown := channel.floodMuteSeconds
+	if cooldown <= 0 {
+		cooldown = DefaultFloodMuteSeconds
+	}
+
+	if channel.quietMasks == nil {
+		channel.quietMasks = NewUserMaskSet()
+	}
+
+	mask := NewName(client.nickMaskString)
+	channel.quietMasks.Add(mask)
+
+	time.AfterFunc(time.Duration(cooldown)*time.Second, func() {
+		channel.quietMasks.Remove(mask)
+	})
+}
+
+// isQuieted reports whether client is currently covered by an
+// auto-mute from the flood governor.
+func (channel *Channel) isQuieted(client *Client) bool {
+	return channel.quietMasks != nil && channel.quietMasks.Match(client.UserHost())
+}
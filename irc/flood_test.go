@@ -0,0 +1,55 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFloodConfig(t *testing.T) {
+	conf, ok := parseFloodConfig("5:10")
+	if !ok || conf.Lines != 5 || conf.Seconds != 10 {
+		t.Fatalf("got %+v, %v; want {5 10}, true", conf, ok)
+	}
+
+	if _, ok := parseFloodConfig("bogus"); ok {
+		t.Fatal("got ok=true for a malformed +F argument")
+	}
+	if _, ok := parseFloodConfig("0:10"); ok {
+		t.Fatal("got ok=true for zero lines")
+	}
+}
+
+func TestTokenBucketTakeExhaustsCapacity(t *testing.T) {
+	bucket := newTokenBucket(floodConfig{Lines: 2, Seconds: 60})
+
+	if !bucket.Take() {
+		t.Fatal("first Take should succeed with a full bucket")
+	}
+	if !bucket.Take() {
+		t.Fatal("second Take should succeed with a full bucket")
+	}
+	if bucket.Take() {
+		t.Fatal("third Take should fail once capacity is exhausted")
+	}
+}
+
+func TestTokenBucketTakeRefillsOverTime(t *testing.T) {
+	bucket := newTokenBucket(floodConfig{Lines: 1, Seconds: 60})
+
+	if !bucket.Take() {
+		t.Fatal("first Take should succeed with a full bucket")
+	}
+	if bucket.Take() {
+		t.Fatal("second Take should fail before any time has passed")
+	}
+
+	// simulate a full period elapsing without sleeping in the test
+	bucket.last = bucket.last.Add(-60 * time.Second)
+
+	if !bucket.Take() {
+		t.Fatal("Take should succeed again once a full period has elapsed")
+	}
+}
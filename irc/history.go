@@ -0,0 +1,375 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryEventType identifies the kind of event a HistoryEvent records.
+type HistoryEventType uint
+
+const (
+	HistoryPrivMsg HistoryEventType = iota
+	HistoryNotice
+	HistoryJoin
+	HistoryPart
+	HistoryKick
+	HistoryTopic
+)
+
+// DefaultHistoryLimit is how many events a channel's ring buffer keeps.
+// NewChannel always uses it; no server config setting overrides it.
+const DefaultHistoryLimit = 1024
+
+// HistoryEvent is a single recorded channel event, addressable by a
+// monotonically increasing Msgid (unique per channel) and a server-time.
+type HistoryEvent struct {
+	Msgid   uint64
+	Time    time.Time
+	Type    HistoryEventType
+	Source  string // nickmask of whoever caused the event
+	Target  string // KICK's victim, if any
+	Message string
+}
+
+// HistoryQuery describes a CHATHISTORY sub-verb request against a
+// channel's ring buffer.
+type HistoryQuery struct {
+	Subcommand string // LATEST, BEFORE, AFTER, AROUND, BETWEEN
+	Before     uint64
+	After      uint64
+	Limit      int
+}
+
+// channelHistory is a fixed-size ring buffer of HistoryEvents for a
+// single channel. It is safe for concurrent use.
+type channelHistory struct {
+	sync.Mutex
+	events []HistoryEvent
+	limit  int
+	start  int // index of the oldest event
+	count  int
+	nextID uint64
+}
+
+func NewChannelHistory(limit int) *channelHistory {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	return &channelHistory{
+		events: make([]HistoryEvent, limit),
+		limit:  limit,
+	}
+}
+
+// restore repopulates the ring buffer from events loaded from
+// persistent storage, oldest-first, preserving their original Msgid and
+// Time rather than assigning fresh ones, and fast-forwards nextID so
+// subsequent Appends don't collide with a restored Msgid.
+func (history *channelHistory) restore(events []HistoryEvent) {
+	history.Lock()
+	defer history.Unlock()
+
+	for _, event := range events {
+		index := (history.start + history.count) % history.limit
+		history.events[index] = event
+		if history.count < history.limit {
+			history.count++
+		} else {
+			history.start = (history.start + 1) % history.limit
+		}
+		if event.Msgid > history.nextID {
+			history.nextID = event.Msgid
+		}
+	}
+}
+
+// Append records a new event and returns it with its assigned Msgid and
+// timestamp filled in.
+func (history *channelHistory) Append(eventType HistoryEventType, source, target, message string) HistoryEvent {
+	history.Lock()
+	defer history.Unlock()
+
+	history.nextID++
+	event := HistoryEvent{
+		Msgid:   history.nextID,
+		Time:    time.Now().UTC(),
+		Type:    eventType,
+		Source:  source,
+		Target:  target,
+		Message: message,
+	}
+
+	index := (history.start + history.count) % history.limit
+	history.events[index] = event
+	if history.count < history.limit {
+		history.count++
+	} else {
+		history.start = (history.start + 1) % history.limit
+	}
+
+	return event
+}
+
+// Select runs a HistoryQuery against the buffer, returning matching
+// events oldest-first.
+func (history *channelHistory) Select(query HistoryQuery) []HistoryEvent {
+	history.Lock()
+	all := history.allLocked()
+	history.Unlock()
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+
+	switch strings.ToUpper(query.Subcommand) {
+	case "LATEST":
+		if len(all) > limit {
+			all = all[len(all)-limit:]
+		}
+		return all
+
+	case "BEFORE":
+		return lastMatching(all, limit, func(e HistoryEvent) bool {
+			return e.Msgid < query.Before
+		})
+
+	case "AFTER":
+		return firstMatching(all, limit, func(e HistoryEvent) bool {
+			return e.Msgid > query.After
+		})
+
+	case "BETWEEN":
+		return firstMatching(all, limit, func(e HistoryEvent) bool {
+			return e.Msgid > query.After && e.Msgid < query.Before
+		})
+
+	case "AROUND":
+		return around(all, query.After, limit)
+	}
+
+	return nil
+}
+
+func (history *channelHistory) allLocked() []HistoryEvent {
+	all := make([]HistoryEvent, history.count)
+	for i := 0; i < history.count; i++ {
+		all[i] = history.events[(history.start+i)%history.limit]
+	}
+	return all
+}
+
+func firstMatching(events []HistoryEvent, limit int, match func(HistoryEvent) bool) []HistoryEvent {
+	result := make([]HistoryEvent, 0, limit)
+	for _, event := range events {
+		if match(event) {
+			result = append(result, event)
+			if len(result) >= limit {
+				break
+			}
+		}
+	}
+	return result
+}
+
+func lastMatching(events []HistoryEvent, limit int, match func(HistoryEvent) bool) []HistoryEvent {
+	result := make([]HistoryEvent, 0, limit)
+	for _, event := range events {
+		if match(event) {
+			result = append(result, event)
+		}
+	}
+	if len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+func around(events []HistoryEvent, target uint64, limit int) []HistoryEvent {
+	center := -1
+	for i, event := range events {
+		if event.Msgid == target {
+			center = i
+			break
+		}
+	}
+	if center == -1 {
+		return nil
+	}
+
+	half := limit / 2
+	lo := center - half
+	if lo < 0 {
+		lo = 0
+	}
+	hi := lo + limit
+	if hi > len(events) {
+		hi = len(events)
+	}
+	return events[lo:hi]
+}
+
+// AppendHistory records an event in the channel's ring buffer and, for
+// persistent channels, queues it for storage in channel_history so it
+// survives a restart.
+func (channel *Channel) AppendHistory(eventType HistoryEventType, source, target, message string) {
+	event := channel.history.Append(eventType, source, target, message)
+
+	if channel.flags[Persistent] {
+		channel.persistHistoryEvent(event)
+	}
+}
+
+// HistorySelect answers a CHATHISTORY query, but only for clients who
+// are allowed to see this channel's history: members always may, and
+// non-members may only if the channel is neither +s nor +n-restricted
+// to outsiders. allowed is false only for that access check, so the
+// caller can tell "denied" apart from "no events matched" - both of
+// which would otherwise show up as a nil/empty events slice.
+func (channel *Channel) HistorySelect(client *Client, query HistoryQuery) (events []HistoryEvent, allowed bool) {
+	isMember := channel.members.Has(client)
+	if !isMember && (channel.flags[Secret] || channel.flags[NoOutside]) {
+		return nil, false
+	}
+	return channel.history.Select(query), true
+}
+
+// persistHistoryEvent queues event to be written to channel_history on
+// the ChannelStore's write-behind goroutine, the same queue Snapshot
+// uses, so a busy history channel never blocks on disk I/O.
+func (channel *Channel) persistHistoryEvent(event HistoryEvent) {
+	name := channel.name.String()
+	channel.server.channelStore.enqueue(func(db *sql.DB) {
+		_, err := db.Exec(`
+            INSERT OR REPLACE INTO channel_history
+              (channel, msgid, time, event_type, source, target, message)
+              VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			name, event.Msgid, event.Time.Format(time.RFC3339),
+			int(event.Type), event.Source, event.Target, event.Message)
+		if err != nil {
+			log.Println("Channel.persistHistoryEvent:", name, err)
+		}
+	})
+}
+
+// replayHistory streams the last `count` buffered events to a client,
+// wrapped in a `batch` labeled chathistory for clients that negotiated
+// the batch capability, as happens automatically on JOIN.
+func (channel *Channel) replayHistory(client *Client, count int) {
+	events := channel.history.Select(HistoryQuery{Subcommand: "LATEST", Limit: count})
+	if len(events) == 0 {
+		return
+	}
+
+	useBatch := client.capabilities[Batch]
+	batchID := "chathistory"
+	if useBatch {
+		client.Send(nil, client.server.name, "BATCH", "+"+batchID, "chathistory", channel.nameString)
+	}
+
+	for _, event := range events {
+		channel.sendHistoryEvent(client, event)
+	}
+
+	if useBatch {
+		client.Send(nil, client.server.name, "BATCH", "-"+batchID)
+	}
+}
+
+// sendHistoryEvent replays a single buffered event to client as though it
+// were happening live, tagged with the event's original time and msgid
+// rather than the moment of replay.
+func (channel *Channel) sendHistoryEvent(client *Client, event HistoryEvent) {
+	tags := Tags{
+		"time":  event.Time.Format("2006-01-02T15:04:05.000Z"),
+		"msgid": strconv.FormatUint(event.Msgid, 10),
+	}
+
+	switch event.Type {
+	case HistoryPrivMsg:
+		client.taggedSend(tags, event.Source, "PRIVMSG", channel.nameString, event.Message)
+	case HistoryNotice:
+		client.taggedSend(tags, event.Source, "NOTICE", channel.nameString, event.Message)
+	case HistoryJoin:
+		client.taggedSend(tags, event.Source, "JOIN", channel.nameString)
+	case HistoryPart:
+		client.taggedSend(tags, event.Source, "PART", channel.nameString, event.Message)
+	case HistoryKick:
+		client.taggedSend(tags, event.Source, "KICK", channel.nameString, event.Target, event.Message)
+	case HistoryTopic:
+		client.taggedSend(tags, event.Source, "TOPIC", channel.nameString, event.Message)
+	}
+}
+
+// ChatHistory implements the CHATHISTORY command's sub-verbs (LATEST,
+// BEFORE, AFTER, AROUND, BETWEEN), replaying matching events to client,
+// inside a batch if client negotiated the batch capability.
+// `before`/`after` accept either a `msgid=<n>` selector
+// or a `timestamp=<RFC3339>` selector, per the draft/chathistory spec.
+func (channel *Channel) ChatHistory(client *Client, subcommand, beforeSelector, afterSelector string, limit int) {
+	query := HistoryQuery{
+		Subcommand: subcommand,
+		Before:     parseHistorySelector(channel, beforeSelector),
+		After:      parseHistorySelector(channel, afterSelector),
+		Limit:      limit,
+	}
+
+	events, allowed := channel.HistorySelect(client, query)
+	if !allowed {
+		client.Send(nil, client.server.name, ERR_NOSUCHCHANNEL, channel.nameString, "Cannot view history for that channel")
+		return
+	}
+
+	useBatch := client.capabilities[Batch]
+	batchID := "chathistory"
+	if useBatch {
+		client.Send(nil, client.server.name, "BATCH", "+"+batchID, "chathistory", channel.nameString)
+	}
+	for _, event := range events {
+		channel.sendHistoryEvent(client, event)
+	}
+	if useBatch {
+		client.Send(nil, client.server.name, "BATCH", "-"+batchID)
+	}
+}
+
+// parseHistorySelector turns a msgid= or timestamp= selector string into
+// the internal Msgid space; a timestamp is resolved to the Msgid of the
+// nearest event at or before it.
+func parseHistorySelector(channel *Channel, selector string) uint64 {
+	if selector == "" {
+		return 0
+	}
+
+	if strings.HasPrefix(selector, "msgid=") {
+		id, err := strconv.ParseUint(strings.TrimPrefix(selector, "msgid="), 10, 64)
+		if err != nil {
+			return 0
+		}
+		return id
+	}
+
+	if strings.HasPrefix(selector, "timestamp=") {
+		ts, err := time.Parse(time.RFC3339, strings.TrimPrefix(selector, "timestamp="))
+		if err != nil {
+			return 0
+		}
+		var found uint64
+		for _, event := range channel.history.Select(HistoryQuery{Subcommand: "LATEST", Limit: DefaultHistoryLimit}) {
+			if !event.Time.After(ts) {
+				found = event.Msgid
+			}
+		}
+		return found
+	}
+
+	return 0
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import "testing"
+
+func TestChannelHistoryAppendAssignsIncreasingMsgid(t *testing.T) {
+	history := NewChannelHistory(10)
+
+	first := history.Append(HistoryPrivMsg, "alice!a@h", "", "hi")
+	second := history.Append(HistoryPrivMsg, "bob!b@h", "", "hey")
+
+	if first.Msgid != 1 || second.Msgid != 2 {
+		t.Fatalf("got msgids %d, %d; want 1, 2", first.Msgid, second.Msgid)
+	}
+}
+
+func TestChannelHistoryWraparoundEvictsOldest(t *testing.T) {
+	history := NewChannelHistory(3)
+
+	for i := 0; i < 5; i++ {
+		history.Append(HistoryPrivMsg, "alice!a@h", "", "msg")
+	}
+
+	all := history.Select(HistoryQuery{Subcommand: "LATEST", Limit: 10})
+	if len(all) != 3 {
+		t.Fatalf("got %d events; want 3 (ring buffer capacity)", len(all))
+	}
+	// the oldest two events (msgid 1, 2) should have been evicted
+	if all[0].Msgid != 3 || all[2].Msgid != 5 {
+		t.Fatalf("got msgids %d..%d; want 3..5", all[0].Msgid, all[2].Msgid)
+	}
+}
+
+func TestChannelHistorySelectLatestRespectsLimit(t *testing.T) {
+	history := NewChannelHistory(10)
+	for i := 0; i < 5; i++ {
+		history.Append(HistoryPrivMsg, "alice!a@h", "", "msg")
+	}
+
+	events := history.Select(HistoryQuery{Subcommand: "LATEST", Limit: 2})
+	if len(events) != 2 {
+		t.Fatalf("got %d events; want 2", len(events))
+	}
+	if events[0].Msgid != 4 || events[1].Msgid != 5 {
+		t.Fatalf("got msgids %d, %d; want 4, 5", events[0].Msgid, events[1].Msgid)
+	}
+}
+
+func TestChannelHistorySelectAroundFound(t *testing.T) {
+	history := NewChannelHistory(10)
+	for i := 0; i < 5; i++ {
+		history.Append(HistoryPrivMsg, "alice!a@h", "", "msg")
+	}
+
+	events := history.Select(HistoryQuery{Subcommand: "AROUND", After: 3, Limit: 3})
+	if len(events) == 0 {
+		t.Fatal("got no events; want events around msgid 3")
+	}
+	found := false
+	for _, event := range events {
+		if event.Msgid == 3 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("got events %v; want msgid 3 included", events)
+	}
+}
+
+func TestChannelHistorySelectAroundNotFound(t *testing.T) {
+	history := NewChannelHistory(10)
+	history.Append(HistoryPrivMsg, "alice!a@h", "", "msg")
+
+	events := history.Select(HistoryQuery{Subcommand: "AROUND", After: 999, Limit: 3})
+	if events != nil {
+		t.Fatalf("got %v; want nil for a msgid never seen", events)
+	}
+}
+
+func TestChannelHistoryRestorePreservesMsgidAndFastForwards(t *testing.T) {
+	history := NewChannelHistory(10)
+
+	history.restore([]HistoryEvent{
+		{Msgid: 5, Source: "alice!a@h", Type: HistoryPrivMsg, Message: "old"},
+		{Msgid: 6, Source: "bob!b@h", Type: HistoryPrivMsg, Message: "older"},
+	})
+
+	all := history.Select(HistoryQuery{Subcommand: "LATEST", Limit: 10})
+	if len(all) != 2 || all[0].Msgid != 5 || all[1].Msgid != 6 {
+		t.Fatalf("got %v; want restored events with msgids 5, 6", all)
+	}
+
+	next := history.Append(HistoryPrivMsg, "carol!c@h", "", "new")
+	if next.Msgid != 7 {
+		t.Fatalf("got msgid %d; want 7 (restore must fast-forward nextID)", next.Msgid)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+// ChannelPrivLadder orders every channel privilege mode from highest to
+// lowest: ChannelFounder > ChannelAdmin > ChannelOperator > Halfop >
+// Voice. Halfop sits one tier below ChannelOperator; checks made through
+// clientHasAtLeast honor it, while ClientIsOperator (used for keys,
+// limits and invites) still accepts only ChannelOperator.
+var ChannelPrivLadder = []ChannelMode{ChannelFounder, ChannelAdmin, ChannelOperator, Halfop, Voice}
+
+// levelForMode returns the ladder level a member holding exactly mode
+// (and nothing higher) would have, per ClientPrivLevel - 0 if mode
+// isn't on the ladder at all.
+func levelForMode(mode ChannelMode) int {
+	for i, m := range ChannelPrivLadder {
+		if m == mode {
+			return len(ChannelPrivLadder) - i
+		}
+	}
+	return 0
+}
+
+// ClientPrivLevel returns client's rank on channel's privilege ladder:
+// 0 for no special privilege, rising by one per rung of
+// ChannelPrivLadder. Compare two levels with > to ask "does A outrank
+// B".
+func (channel *Channel) ClientPrivLevel(client *Client) int {
+	best := 0
+	for _, mode := range ChannelPrivLadder {
+		if channel.members.HasMode(client, mode) {
+			if level := levelForMode(mode); level > best {
+				best = level
+			}
+		}
+	}
+	return best
+}
+
+// HasPrivOver reports whether client strictly outranks target on
+// channel's privilege ladder.
+func (channel *Channel) HasPrivOver(client, target *Client) bool {
+	return channel.ClientPrivLevel(client) > channel.ClientPrivLevel(target)
+}
+
+// clientHasAtLeast reports whether client holds mode or anything higher
+// on channel's privilege ladder (global Operator always qualifies).
+func (channel *Channel) clientHasAtLeast(client *Client, mode ChannelMode) bool {
+	return client.flags[Operator] || channel.ClientPrivLevel(client) >= levelForMode(mode)
+}
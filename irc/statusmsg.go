@@ -0,0 +1,96 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+// StatusmsgPrefixes lists the channel-membership prefixes, highest
+// privilege first, that may prefix a PRIVMSG/NOTICE target to restrict
+// delivery to members holding at least that privilege — e.g. `@#chan`
+// reaches ops and above, `+#chan` reaches voice and above.
+// StatusmsgISupportToken builds the matching ISUPPORT token; nothing in
+// this package adds it to the ISUPPORT reply.
+const StatusmsgPrefixes = "~&@%+"
+
+// StatusmsgISupportToken is the ISUPPORT token advertising which
+// prefixes are accepted as STATUSMSG targets.
+func StatusmsgISupportToken() string {
+	return "STATUSMSG=" + StatusmsgPrefixes
+}
+
+// modeForStatusPrefix resolves a STATUSMSG prefix byte (as taken from
+// the leading character of a target like `@#chan`) to the channel mode
+// that is the minimum privilege required to receive it.
+func modeForStatusPrefix(prefix byte) (mode ChannelMode, ok bool) {
+	for _, m := range ChannelPrivLadder {
+		if p := ChannelModePrefixes[m]; len(p) > 0 && p[0] == prefix {
+			return m, true
+		}
+	}
+	return mode, false
+}
+
+// canSpeakStatus is CanSpeak's counterpart for a STATUSMSG send: the
+// usual NoOutside check still applies, but Moderated doesn't block a
+// send that's restricted to ops-and-above anyway, since ordinary
+// members were never going to see it.
+func (channel *Channel) canSpeakStatus(client *Client, minMode ChannelMode) bool {
+	if client.flags[Operator] {
+		return true
+	}
+	if channel.isQuieted(client) {
+		return false
+	}
+	if channel.flags[NoOutside] && !channel.members.Has(client) {
+		return false
+	}
+
+	targetsOpsOrAbove := levelForMode(minMode) >= levelForMode(ChannelOperator)
+	if channel.flags[Moderated] && !targetsOpsOrAbove &&
+		!(channel.members.HasMode(client, Voice) || channel.members.HasMode(client, ChannelOperator)) {
+		return false
+	}
+	return true
+}
+
+// PrivMsgStatus sends message to the subset of channel's members
+// holding at least the privilege implied by prefix (one of
+// StatusmsgPrefixes), e.g. PRIVMSG @#chan or PRIVMSG +#chan.
+func (channel *Channel) PrivMsgStatus(client *Client, prefix byte, message string, label string) {
+	channel.sendStatus(client, prefix, "PRIVMSG", message, label)
+}
+
+// NoticeStatus is PrivMsgStatus's counterpart for NOTICE.
+func (channel *Channel) NoticeStatus(client *Client, prefix byte, message string, label string) {
+	channel.sendStatus(client, prefix, "NOTICE", message, label)
+}
+
+func (channel *Channel) sendStatus(client *Client, prefix byte, command, message, label string) {
+	minMode, ok := modeForStatusPrefix(prefix)
+	if !ok {
+		client.Send(nil, client.server.name, ERR_NOSUCHNICK, string(prefix)+channel.nameString, "No such nick/channel")
+		return
+	}
+
+	if !channel.canSpeakStatus(client, minMode) {
+		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.nameString, "Cannot send to channel")
+		return
+	}
+
+	target := string(prefix) + channel.nameString
+	tags := eventTags(client)
+	minLevel := levelForMode(minMode)
+
+	for member := range channel.members {
+		if channel.ClientPrivLevel(member) < minLevel {
+			continue
+		}
+		if member == client {
+			if !client.capabilities[EchoMessage] {
+				continue
+			}
+			member.taggedSend(withLabel(tags, label), client.nickMaskString, command, target, message)
+			continue
+		}
+		member.taggedSend(tags, client.nickMaskString, command, target, message)
+	}
+}
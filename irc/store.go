@@ -0,0 +1,395 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Numerics for the ban/except/invite list replies, sent by ShowMaskList.
+const (
+	RPL_BANLIST         = "367"
+	RPL_ENDOFBANLIST    = "368"
+	RPL_EXCEPTLIST      = "348"
+	RPL_ENDOFEXCEPTLIST = "349"
+	RPL_INVITELIST      = "346"
+	RPL_ENDOFINVITELIST = "347"
+)
+
+// maskEntry records who set a ban/except/invite mask and when, so
+// ShowMaskList and friends can report more than just the mask itself.
+type maskEntry struct {
+	Mask   Name
+	Setter string
+	SetAt  time.Time
+}
+
+// maskMetaFor returns (creating if necessary) the setter/timestamp
+// tracking map for mode.
+func (channel *Channel) maskMetaFor(mode ChannelMode) map[Name]maskEntry {
+	if channel.maskMeta == nil {
+		channel.maskMeta = make(map[ChannelMode]map[Name]maskEntry)
+	}
+	byMask := channel.maskMeta[mode]
+	if byMask == nil {
+		byMask = make(map[Name]maskEntry)
+		channel.maskMeta[mode] = byMask
+	}
+	return byMask
+}
+
+// recordMaskMeta notes that mask was just added to mode's list by
+// setter, for later reporting by ShowMaskList and persistence by
+// ChannelStore.Snapshot.
+func (channel *Channel) recordMaskMeta(mode ChannelMode, mask Name, setter string) {
+	channel.maskMetaFor(mode)[mask] = maskEntry{Mask: mask, Setter: setter, SetAt: time.Now().UTC()}
+}
+
+// forgetMaskMeta discards mask's tracking entry once it's removed from
+// mode's list.
+func (channel *Channel) forgetMaskMeta(mode ChannelMode, mask Name) {
+	delete(channel.maskMeta[mode], mask)
+}
+
+// maskListReplies returns the RPL_*LIST / RPL_ENDOF*LIST numeric pair
+// ShowMaskList should use for mode.
+func maskListReplies(mode ChannelMode) (list, end string) {
+	switch mode {
+	case BanMask:
+		return RPL_BANLIST, RPL_ENDOFBANLIST
+	case ExceptMask:
+		return RPL_EXCEPTLIST, RPL_ENDOFEXCEPTLIST
+	case InviteMask:
+		return RPL_INVITELIST, RPL_ENDOFINVITELIST
+	}
+	return "", ""
+}
+
+// maskKindName and maskKindMode convert between a ChannelMode and the
+// string stored in the channel_mask table's kind column.
+func maskKindName(mode ChannelMode) string {
+	switch mode {
+	case BanMask:
+		return "ban"
+	case ExceptMask:
+		return "except"
+	case InviteMask:
+		return "invite"
+	}
+	return ""
+}
+
+func maskKindMode(kind string) (mode ChannelMode, ok bool) {
+	switch kind {
+	case "ban":
+		return BanMask, true
+	case "except":
+		return ExceptMask, true
+	case "invite":
+		return InviteMask, true
+	}
+	return mode, false
+}
+
+var maskModes = []ChannelMode{BanMask, ExceptMask, InviteMask}
+
+// extBanKind is the channel_mask.kind value used for extended-ban-syntax
+// entries ($a:, $~a, $r:, $j:, $#forward), which are stored keyed by
+// their raw mask string rather than parsed into a plain UserMaskSet.
+const extBanKind = "extban"
+
+// migrations upgrades a channel database one schema_version step at a
+// time; index i brings a fresh database from version i to i+1.
+var migrations = []func(*sql.DB) error{
+	func(db *sql.DB) error {
+		_, err := db.Exec(`
+            CREATE TABLE IF NOT EXISTS channel (
+                name TEXT PRIMARY KEY,
+                flags TEXT,
+                key TEXT,
+                topic TEXT,
+                user_limit INTEGER,
+                flood TEXT
+            )`)
+		return err
+	},
+	func(db *sql.DB) error {
+		_, err := db.Exec(`
+            CREATE TABLE IF NOT EXISTS channel_mask (
+                channel TEXT,
+                kind TEXT,
+                mask TEXT,
+                setter TEXT,
+                set_at TEXT,
+                PRIMARY KEY (channel, kind, mask)
+            )`)
+		return err
+	},
+	func(db *sql.DB) error {
+		_, err := db.Exec(`
+            CREATE TABLE IF NOT EXISTS channel_history (
+                channel TEXT,
+                msgid INTEGER,
+                time TEXT,
+                event_type INTEGER,
+                source TEXT,
+                target TEXT,
+                message TEXT,
+                PRIMARY KEY (channel, msgid)
+            )`)
+		return err
+	},
+}
+
+// ChannelStore owns channel persistence: it applies schema migrations
+// up front, then takes writes off a queue so that SetTopic, Mode,
+// Invite and friends never block on disk I/O.
+type ChannelStore struct {
+	db    *sql.DB
+	queue chan func(*sql.DB)
+}
+
+// NewChannelStore migrates db to the latest schema and starts the
+// store's write-behind worker.
+func NewChannelStore(db *sql.DB) (*ChannelStore, error) {
+	store := &ChannelStore{
+		db:    db,
+		queue: make(chan func(*sql.DB), 256),
+	}
+	if err := store.migrate(); err != nil {
+		return nil, err
+	}
+	go store.run()
+	return store, nil
+}
+
+func (store *ChannelStore) migrate() error {
+	if _, err := store.db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var applied int
+	if err := store.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&applied); err != nil {
+		return err
+	}
+
+	for i := applied; i < len(migrations); i++ {
+		if err := migrations[i](store.db); err != nil {
+			return err
+		}
+		if _, err := store.db.Exec(`INSERT INTO schema_version (version) VALUES (?)`, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *ChannelStore) run() {
+	for job := range store.queue {
+		job(store.db)
+	}
+}
+
+// enqueue schedules job to run on the store's single writer goroutine,
+// asynchronously and in submission order.
+func (store *ChannelStore) enqueue(job func(*sql.DB)) {
+	store.queue <- job
+}
+
+// Snapshot schedules channel's current flags, key, topic, limit, flood
+// config and mask metadata to be written to disk, replacing whatever
+// was there before. The caller isn't blocked on disk I/O.
+func (store *ChannelStore) Snapshot(channel *Channel) {
+	name := channel.name.String()
+
+	if !channel.flags[Persistent] {
+		store.enqueue(func(db *sql.DB) {
+			if err := runInTx(db, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(`DELETE FROM channel WHERE name = ?`, name); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`DELETE FROM channel_mask WHERE channel = ?`, name)
+				return err
+			}); err != nil {
+				log.Println("ChannelStore.Snapshot:", name, err)
+			}
+		})
+		return
+	}
+
+	flags := channel.flags.String()
+	key := channel.key
+	topic := channel.topic
+	userLimit := channel.userLimit
+	flood := channel.msgBucket.String()
+
+	var entries []maskEntry
+	var kinds []string
+	for _, mode := range maskModes {
+		kind := maskKindName(mode)
+		for _, entry := range channel.maskMeta[mode] {
+			entries = append(entries, entry)
+			kinds = append(kinds, kind)
+		}
+	}
+	for _, ban := range channel.banExtra {
+		entries = append(entries, maskEntry{Mask: NewName(ban.raw), Setter: ban.Setter, SetAt: ban.SetAt})
+		kinds = append(kinds, extBanKind)
+	}
+
+	store.enqueue(func(db *sql.DB) {
+		err := runInTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`
+                INSERT OR REPLACE INTO channel
+                  (name, flags, key, topic, user_limit, flood)
+                  VALUES (?, ?, ?, ?, ?, ?)`,
+				name, flags, key, topic, userLimit, flood); err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(`DELETE FROM channel_mask WHERE channel = ?`, name); err != nil {
+				return err
+			}
+			for i, entry := range entries {
+				if _, err := tx.Exec(`
+                    INSERT OR REPLACE INTO channel_mask
+                      (channel, kind, mask, setter, set_at)
+                      VALUES (?, ?, ?, ?, ?)`,
+					name, kinds[i], entry.Mask.String(), entry.Setter, entry.SetAt.Format(time.RFC3339)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("ChannelStore.Snapshot:", name, err)
+		}
+	})
+}
+
+// runInTx runs fn inside a transaction, committing on a nil return and
+// rolling back otherwise, so a snapshot's several statements either all
+// land or none do.
+func runInTx(db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// LoadChannel rehydrates a persisted channel's flags, key, topic,
+// limit, flood config, masks and history from the store. Nothing in
+// this package calls it on server startup.
+func LoadChannel(s *Server, name Name) (*Channel, error) {
+	var flagsStr, key, topic, flood string
+	var userLimit uint64
+	row := s.channelStore.db.QueryRow(`
+        SELECT flags, key, topic, user_limit, flood FROM channel WHERE name = ?`,
+		name.String())
+	if err := row.Scan(&flagsStr, &key, &topic, &userLimit, &flood); err != nil {
+		return nil, err
+	}
+
+	channel := NewChannel(s, name, false)
+	for _, mode := range parseChannelFlags(flagsStr) {
+		channel.flags[mode] = true
+	}
+	channel.key = key
+	channel.topic = topic
+	channel.userLimit = userLimit
+	if conf, ok := parseFloodConfig(flood); ok {
+		channel.msgBucket = conf
+	}
+
+	rows, err := s.channelStore.db.Query(`
+        SELECT kind, mask, setter, set_at FROM channel_mask WHERE channel = ?`,
+		name.String())
+	if err != nil {
+		return channel, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, mask, setter, setAtStr string
+		if err := rows.Scan(&kind, &mask, &setter, &setAtStr); err != nil {
+			return channel, err
+		}
+		setAt, _ := time.Parse(time.RFC3339, setAtStr)
+
+		if kind == extBanKind {
+			if ban, ok := parseExtBan(mask); ok {
+				ban.Setter = setter
+				ban.SetAt = setAt
+				channel.banExtra = append(channel.banExtra, ban)
+			}
+			continue
+		}
+
+		mode, ok := maskKindMode(kind)
+		if !ok {
+			continue
+		}
+		maskName := NewName(mask)
+		channel.lists[mode].Add(maskName)
+		channel.maskMetaFor(mode)[maskName] = maskEntry{Mask: maskName, Setter: setter, SetAt: setAt}
+	}
+
+	if err := loadChannelHistory(s, channel); err != nil {
+		return channel, err
+	}
+
+	return channel, nil
+}
+
+// loadChannelHistory rehydrates channel's ring buffer from the
+// channel_history table, in Msgid order, so a persistent channel's
+// chat history survives a server restart.
+func loadChannelHistory(s *Server, channel *Channel) error {
+	rows, err := s.channelStore.db.Query(`
+        SELECT msgid, time, event_type, source, target, message
+          FROM channel_history WHERE channel = ? ORDER BY msgid ASC`,
+		channel.name.String())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var events []HistoryEvent
+	for rows.Next() {
+		var event HistoryEvent
+		var timeStr string
+		var eventType int
+		if err := rows.Scan(&event.Msgid, &timeStr, &eventType, &event.Source, &event.Target, &event.Message); err != nil {
+			return err
+		}
+		event.Time, _ = time.Parse(time.RFC3339, timeStr)
+		event.Type = HistoryEventType(eventType)
+		events = append(events, event)
+	}
+
+	channel.history.restore(events)
+	return nil
+}
+
+// parseChannelFlags turns a persisted ChannelModeSet.String() back into
+// the set of modes it represents: a leading "+" followed by one mode
+// character per flag, e.g. "+nt".
+func parseChannelFlags(s string) []ChannelMode {
+	var modes []ChannelMode
+	for _, r := range s {
+		if r == '+' || r == '-' {
+			continue
+		}
+		modes = append(modes, ChannelMode(r))
+	}
+	return modes
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2016- Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Capability identifies an IRCv3 client capability negotiated via CAP
+// REQ, such as the existing MultiPrefix.
+type Capability string
+
+// IRCv3 message-tags capabilities that gate which tags taggedSend will
+// actually deliver to a given client.
+const (
+	ServerTime      Capability = "server-time"
+	MessageTags     Capability = "message-tags"
+	AccountTag      Capability = "account-tag"
+	EchoMessage     Capability = "echo-message"
+	LabeledResponse Capability = "labeled-response"
+	Batch           Capability = "batch"
+	ChatHistoryCap  Capability = "draft/chathistory"
+)
+
+// Tags is the IRCv3 message-tags set attached to an outbound message,
+// keyed by tag name without the leading '@' or trailing ';'.
+type Tags map[string]string
+
+var msgidCounter uint64
+
+// GenerateMsgid returns a process-unique, lexically sortable msgid: the
+// current time plus a monotonic counter, giving ULID-like ordering
+// without pulling in an external ULID/UUIDv7 dependency.
+func GenerateMsgid() string {
+	n := atomic.AddUint64(&msgidCounter, 1)
+	return strconv.FormatInt(time.Now().UTC().UnixNano(), 36) + "-" + strconv.FormatUint(n, 36)
+}
+
+// eventTags builds the standard time/msgid/account tags for an outbound
+// event caused by source. source may be nil for server-generated events.
+func eventTags(source *Client) Tags {
+	tags := Tags{
+		"time":  time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		"msgid": GenerateMsgid(),
+	}
+	if source != nil && source.account != "" {
+		tags["account"] = source.account
+	}
+	return tags
+}
+
+// taggedSend sends prefix/command/params to client, first stripping any
+// tags the client hasn't negotiated support for via CAP REQ.
+func (client *Client) taggedSend(tags Tags, prefix, command string, params ...string) {
+	client.Send(client.filterTags(tags), prefix, command, params...)
+}
+
+// filterTags drops tags the client hasn't negotiated, returning nil
+// (meaning: send untagged) rather than an empty map.
+func (client *Client) filterTags(tags Tags) Tags {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	filtered := make(Tags, len(tags))
+	for key, value := range tags {
+		switch key {
+		case "time":
+			if !client.capabilities[ServerTime] {
+				continue
+			}
+		case "msgid":
+			if !client.capabilities[MessageTags] {
+				continue
+			}
+		case "account":
+			if !client.capabilities[AccountTag] {
+				continue
+			}
+		case "label":
+			if !client.capabilities[LabeledResponse] {
+				continue
+			}
+		}
+		filtered[key] = value
+	}
+
+	if len(filtered) == 0 {
+		return nil
+	}
+	return filtered
+}
+
+// broadcastTagged sends a tagged message, from source, to every member
+// of the channel including source itself (the normal case for JOIN,
+// PART, KICK, TOPIC and MODE, which have always echoed back to their
+// originator). source's own copy carries label, if any, so it can
+// correlate the echo with its own labeled request.
+func (channel *Channel) broadcastTagged(source *Client, label string, tags Tags, command string, params ...string) {
+	for member := range channel.members {
+		if member == source {
+			member.taggedSend(withLabel(tags, label), source.nickMaskString, command, params...)
+			continue
+		}
+		member.taggedSend(tags, source.nickMaskString, command, params...)
+	}
+}
+
+// broadcastTaggedEcho is broadcastTagged's counterpart for PRIVMSG and
+// NOTICE, which historically skip the sender. With echo-message
+// negotiated, source receives its own message back (labeled, if
+// labeled-response applies); without it, source is skipped as before.
+func (channel *Channel) broadcastTaggedEcho(source *Client, label string, tags Tags, command string, params ...string) {
+	for member := range channel.members {
+		if member == source {
+			if !source.capabilities[EchoMessage] {
+				continue
+			}
+			member.taggedSend(withLabel(tags, label), source.nickMaskString, command, params...)
+			continue
+		}
+		member.taggedSend(tags, source.nickMaskString, command, params...)
+	}
+}
+
+// withLabel returns a copy of tags with label attached under "label",
+// or tags unchanged if label is empty.
+func withLabel(tags Tags, label string) Tags {
+	if label == "" {
+		return tags
+	}
+	labeled := make(Tags, len(tags)+1)
+	for k, v := range tags {
+		labeled[k] = v
+	}
+	labeled["label"] = label
+	return labeled
+}
+
+// sendBatch wraps the sends performed by body in a `batch` of type
+// batchType, labeled with label so a client with labeled-response can
+// match the whole group back to its triggering command. If label is
+// empty, body just runs unwrapped.
+func (client *Client) sendBatch(label, batchType string, body func()) {
+	if label == "" || !client.capabilities[LabeledResponse] {
+		body()
+		return
+	}
+
+	batchID := GenerateMsgid()
+	client.taggedSend(Tags{"label": label}, client.server.name, "BATCH", "+"+batchID, batchType)
+	body()
+	client.Send(nil, client.server.name, "BATCH", "-"+batchID)
+}